@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	EventAdBreakStarted = "ad_break_started"
+	EventAdBreakEnded   = "ad_break_ended"
+	EventStreamOnline   = "stream_online"
+	EventStreamOffline  = "stream_offline"
+	EventPlaylistError  = "playlist_error"
+
+	eventHistorySize = 1000
+)
+
+// Event is a single state transition observed by a channel watcher. Events
+// are delivered both over SSE and as signed outbound webhooks.
+type Event struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Channel string    `json:"channel"`
+	Data    any       `json:"data,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// eventBus fans state-transition events out to SSE subscribers and
+// configured webhooks, keeping a bounded history so SSE clients can resume
+// from a Last-Event-ID after a reconnect.
+type eventBus struct {
+	mu          sync.Mutex
+	seq         uint64
+	history     []Event
+	subscribers map[chan Event]struct{}
+
+	webhookURLs   []string
+	webhookSecret string
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subscribers:   make(map[chan Event]struct{}),
+		webhookURLs:   webhookURLsFromEnv(),
+		webhookSecret: os.Getenv("WEBHOOK_SECRET"),
+	}
+}
+
+func webhookURLsFromEnv() []string {
+	raw := os.Getenv("WEBHOOK_URLS")
+
+	if raw == "" {
+		return nil
+	}
+
+	var urls []string
+
+	for _, url := range strings.Split(raw, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+
+	return urls
+}
+
+// Publish records the event, pushes it to live SSE subscribers and dispatches
+// it to every configured webhook.
+func (b *eventBus) Publish(eventType, channel string, data any) {
+	b.mu.Lock()
+
+	b.seq++
+
+	evt := Event{
+		ID:      strconv.FormatUint(b.seq, 10),
+		Type:    eventType,
+		Channel: channel,
+		Data:    data,
+		Time:    time.Now(),
+	}
+
+	b.history = append(b.history, evt)
+
+	if len(b.history) > eventHistorySize {
+		b.history = b.history[len(b.history)-eventHistorySize:]
+	}
+
+	subscribers := make([]chan Event, 0, len(b.subscribers))
+
+	for ch := range b.subscribers {
+		subscribers = append(subscribers, ch)
+	}
+
+	b.mu.Unlock()
+
+	for _, ch := range subscribers {
+		select {
+		case ch <- evt:
+		default:
+		}
+	}
+
+	go b.deliverWebhooks(evt)
+}
+
+// Subscribe registers a new SSE subscriber and returns its channel along
+// with an unsubscribe function the caller must defer.
+func (b *eventBus) Subscribe() (chan Event, func()) {
+	ch := make(chan Event, 16)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+
+		close(ch)
+	}
+}
+
+// Since returns every event recorded after lastID, for SSE resume support.
+func (b *eventBus) Since(lastID string) []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id, err := strconv.ParseUint(lastID, 10, 64)
+
+	if err != nil {
+		return nil
+	}
+
+	var events []Event
+
+	for _, evt := range b.history {
+		seq, _ := strconv.ParseUint(evt.ID, 10, 64)
+
+		if seq > id {
+			events = append(events, evt)
+		}
+	}
+
+	return events
+}
+
+func (b *eventBus) deliverWebhooks(evt Event) {
+	if len(b.webhookURLs) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(evt)
+
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("An error occured while marshaling webhook payload")
+
+		return
+	}
+
+	signature := b.sign(payload)
+
+	for _, url := range b.webhookURLs {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("webhook_url", url).
+				Msg("An error occured while building webhook request")
+
+			continue
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+
+		if signature != "" {
+			req.Header.Set("X-Roli-Signature", signature)
+		}
+
+		resp, err := client.Do(req)
+
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("webhook_url", url).
+				Msg("An error occured while delivering webhook")
+
+			continue
+		}
+
+		resp.Body.Close()
+	}
+}
+
+func (b *eventBus) sign(payload []byte) string {
+	if b.webhookSecret == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, []byte(b.webhookSecret))
+	mac.Write(payload)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	// Subscribe before replaying history, so nothing published between the
+	// replay and the subscription taking effect is lost. Since the replay
+	// can then overlap with what arrives on ch, track the highest sequence
+	// number already sent and skip anything at or below it.
+	ch, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+
+	var lastSeq uint64
+
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		lastSeq, _ = strconv.ParseUint(lastID, 10, 64)
+
+		for _, evt := range events.Since(lastID) {
+			writeSSEEvent(w, evt)
+
+			if seq, err := strconv.ParseUint(evt.ID, 10, 64); err == nil && seq > lastSeq {
+				lastSeq = seq
+			}
+		}
+
+		flusher.Flush()
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case evt := <-ch:
+			if seq, err := strconv.ParseUint(evt.ID, 10, 64); err == nil && seq <= lastSeq {
+				continue
+			}
+
+			writeSSEEvent(w, evt)
+			flusher.Flush()
+		}
+	}
+}
+
+func writeSSEEvent(w http.ResponseWriter, evt Event) {
+	data, err := json.Marshal(evt)
+
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", evt.ID, evt.Type, data)
+}
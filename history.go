@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var historyBucket = []byte("history")
+
+// HistoryRecord is a single observed ad break, persisted so it can be queried
+// later for ad-frequency analytics.
+type HistoryRecord struct {
+	Channel    string    `json:"channel"`
+	StartDate  time.Time `json:"start_date"`
+	RollType   string    `json:"roll_type"`
+	PodLength  int       `json:"pod_length"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// historyStore persists HistoryRecords to a BoltDB file, keyed by channel and
+// detection time so range queries over a single channel stay ordered and
+// cheap to scan.
+type historyStore struct {
+	db *bolt.DB
+}
+
+func openHistoryStore(path string) (*historyStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 1 * time.Second})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(historyBucket)
+
+		return err
+	})
+
+	if err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	return &historyStore{db: db}, nil
+}
+
+// channelPrefix is the key prefix shared by every record for channel, since
+// historyKey lays out keys as channel + 0x00 + big-endian detection time.
+func channelPrefix(channel string) []byte {
+	prefix := make([]byte, len(channel)+1)
+
+	copy(prefix, channel)
+	prefix[len(channel)] = 0
+
+	return prefix
+}
+
+func historyKey(channel string, detectedAt time.Time) []byte {
+	prefix := channelPrefix(channel)
+
+	key := make([]byte, len(prefix)+8)
+	copy(key, prefix)
+
+	binary.BigEndian.PutUint64(key[len(prefix):], uint64(detectedAt.UnixNano()))
+
+	return key
+}
+
+func (s *historyStore) Record(rec HistoryRecord) error {
+	value, err := json.Marshal(rec)
+
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(historyBucket).Put(historyKey(rec.Channel, rec.DetectedAt), value)
+	})
+}
+
+// Query returns every record for channel (or every channel, if empty) whose
+// DetectedAt falls within [since, until]. A zero since/until leaves that end
+// of the range unbounded.
+//
+// When channel is given, it seeks straight to that channel's key prefix and
+// stops as soon as it walks past it (or past until), instead of scanning the
+// whole bucket. An empty channel still has to scan every record, since keys
+// are grouped by channel rather than by time.
+func (s *historyStore) Query(channel string, since, until time.Time) ([]HistoryRecord, error) {
+	var records []HistoryRecord
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyBucket).Cursor()
+
+		if channel == "" {
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				rec, err := decodeHistoryRecord(v)
+
+				if err != nil {
+					return err
+				}
+
+				if inRange(rec, since, until) {
+					records = append(records, rec)
+				}
+			}
+
+			return nil
+		}
+
+		prefix := channelPrefix(channel)
+
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			rec, err := decodeHistoryRecord(v)
+
+			if err != nil {
+				return err
+			}
+
+			if !since.IsZero() && rec.DetectedAt.Before(since) {
+				continue
+			}
+
+			if !until.IsZero() && rec.DetectedAt.After(until) {
+				break
+			}
+
+			records = append(records, rec)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func decodeHistoryRecord(v []byte) (HistoryRecord, error) {
+	var rec HistoryRecord
+
+	err := json.Unmarshal(v, &rec)
+
+	return rec, err
+}
+
+func inRange(rec HistoryRecord, since, until time.Time) bool {
+	if !since.IsZero() && rec.DetectedAt.Before(since) {
+		return false
+	}
+
+	if !until.IsZero() && rec.DetectedAt.After(until) {
+		return false
+	}
+
+	return true
+}
+
+func (s *historyStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	integrityURL = "https://gql.twitch.tv/integrity"
+
+	defaultMaxRetries = 5
+	baseBackoff       = 500 * time.Millisecond
+	maxBackoff        = 30 * time.Second
+)
+
+// deviceIDPool hands out a rotating set of device identifiers so requests
+// aren't all attributed to a single device.
+var deviceIDPool = []string{
+	randomDeviceID(),
+	randomDeviceID(),
+	randomDeviceID(),
+	randomDeviceID(),
+}
+
+func randomDeviceID() string {
+	const charset = "0123456789abcdef"
+
+	id := make([]byte, 32)
+
+	for i := range id {
+		id[i] = charset[rand.Intn(len(charset))]
+	}
+
+	return string(id)
+}
+
+// robustClient wraps an *http.Client with the behavior Twitch's GQL edge now
+// expects: a Client-Integrity handshake attached to every GQL request,
+// retries with backoff+jitter on 429/5xx and network errors, and a rotating
+// pool of device IDs.
+type robustClient struct {
+	inner      *http.Client
+	maxRetries int
+
+	mu              sync.Mutex
+	integrityToken  string
+	integrityDevice string
+	integrityExpiry time.Time
+}
+
+func newRobustClient() *robustClient {
+	return &robustClient{
+		inner: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+		maxRetries: defaultMaxRetries,
+	}
+}
+
+func (c *robustClient) Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Do(req)
+}
+
+func (c *robustClient) Do(req *http.Request) (*http.Response, error) {
+	deviceID := deviceIDPool[rand.Intn(len(deviceIDPool))]
+
+	if req.URL.String() == twitchGraphURL {
+		// The integrity token is only valid for the device ID it was issued
+		// for, so the request must carry whichever device ID the cached (or
+		// freshly fetched) token is actually bound to.
+		token, tokenDeviceID, err := c.integrityTokenFor(deviceID)
+
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("An error occured while fetching integrity token")
+		} else {
+			deviceID = tokenDeviceID
+			req.Header.Set("Client-Integrity", token)
+		}
+	}
+
+	req.Header.Set("Device-ID", deviceID)
+	req.Header.Set("X-Device-Id", deviceID)
+
+	var body []byte
+
+	if req.Body != nil {
+		var err error
+
+		body, err = io.ReadAll(req.Body)
+
+		if err != nil {
+			return nil, err
+		}
+
+		req.Body.Close()
+	}
+
+	var resp *http.Response
+	var err error
+
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		if body != nil {
+			req.Body = io.NopCloser(strings.NewReader(string(body)))
+		}
+
+		resp, err = c.inner.Do(req)
+
+		if err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return resp, nil
+		}
+
+		if attempt == c.maxRetries {
+			break
+		}
+
+		wait := backoffWithJitter(attempt)
+
+		if resp != nil {
+			if retryAfter := retryAfterDuration(resp.Header.Get("Retry-After")); retryAfter > 0 {
+				wait = retryAfter
+			}
+
+			resp.Body.Close()
+		}
+
+		log.Warn().
+			Int("attempt", attempt+1).
+			Dur("wait", wait).
+			Msg("Retrying request")
+
+		time.Sleep(wait)
+	}
+
+	if err == nil && resp != nil {
+		err = fmt.Errorf("request failed after %d attempts: %s", c.maxRetries+1, resp.Status)
+		resp.Body.Close()
+		resp = nil
+	}
+
+	return resp, err
+}
+
+func backoffWithJitter(attempt int) time.Duration {
+	wait := baseBackoff * time.Duration(1<<attempt)
+
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+
+	jitter := time.Duration(rand.Int63n(int64(wait) / 2))
+
+	return wait/2 + jitter
+}
+
+func retryAfterDuration(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if when, err := time.Parse(time.RFC1123, header); err == nil {
+		return time.Until(when)
+	}
+
+	return 0
+}
+
+type integrityResponse struct {
+	Token      string `json:"token"`
+	Expiration int64  `json:"expiration"`
+}
+
+// integrityTokenFor returns a cached Client-Integrity token along with the
+// device ID it was issued for, refreshing it via the /integrity handshake
+// once it's within a minute of expiring. The returned device ID must be used
+// for the request the token is attached to, since Twitch ties a token to the
+// device that requested it.
+func (c *robustClient) integrityTokenFor(deviceID string) (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.integrityToken != "" && time.Until(c.integrityExpiry) > time.Minute {
+		return c.integrityToken, c.integrityDevice, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, integrityURL, nil)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	req.Header.Set("Client-ID", clientID)
+	req.Header.Set("Device-ID", deviceID)
+	req.Header.Set("X-Device-Id", deviceID)
+
+	resp, err := c.inner.Do(req)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("integrity handshake failed: %s", resp.Status)
+	}
+
+	var out integrityResponse
+
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", "", err
+	}
+
+	c.integrityToken = out.Token
+	c.integrityDevice = deviceID
+	c.integrityExpiry = time.UnixMilli(out.Expiration)
+
+	return c.integrityToken, c.integrityDevice, nil
+}
@@ -1,17 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
-	"net/url"
 	"os"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/etherlabsio/go-m3u8/m3u8"
-	"github.com/gookit/goutil/maputil"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/rs/zerolog/pkgerrors"
@@ -26,213 +25,537 @@ type Stitched struct {
 type H = map[string]any
 
 const (
-	graphURL          = "https://gql.twitch.tv/gql"
-	masterPlaylistURL = "https://usher.ttvnw.net/api/channel/hls/%s.m3u8?token=%s&sig=%s"
-
 	playlistInterval = 1 * time.Minute
 	stitchedInterval = 2 * time.Second
 )
 
 var (
-	clientID    = os.Getenv("CLIENT_ID")
+	clientID = os.Getenv("CLIENT_ID")
+
+	// channelName is kept for backward compatibility: if set, it is added
+	// as an initial subscription alongside whatever channels.json restores.
 	channelName = os.Getenv("CHANNEL_NAME")
 
-	client = http.Client{
-		Timeout: 5 * time.Second,
-	}
+	channelsFile = envOr("CHANNELS_FILE", "channels.json")
+	historyFile  = envOr("HISTORY_FILE", "history.db")
+
+	client = newRobustClient()
 
-	currentStitched *Stitched
+	channels = newChannelManager(channelsFile)
+	events   = newEventBus()
+	history  *historyStore
 )
 
-func getAccessToken(channelName string) (string, string, error) {
-	s := fmt.Sprintf(
-		`{"query":"{streamPlaybackAccessToken(channelName:\"%s\",params:{platform:\"web\",playerBackend:\"mediaplayer\",playerType:\"site\"}){signature,value}}"}`,
-		channelName,
-	)
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
 
-	req, err := http.NewRequest("POST", graphURL, strings.NewReader(s))
+	return fallback
+}
 
-	if err != nil {
-		return "", "", err
-	}
+// channelWatcher polls a single channel's playlist and ad-break state on its
+// own goroutine, independently from every other watched channel.
+type channelWatcher struct {
+	name     string
+	channel  string
+	provider Provider
+
+	mu          sync.RWMutex
+	stitched    *Stitched
+	online      bool
+	playlistURL string
+
+	stop chan struct{}
+}
 
-	req.Header.Set("Client-ID", clientID)
-	req.Header.Set("Content-Type", "text/plain")
+// newChannelWatcher builds a watcher for a "provider:channel" subscription
+// spec (or a bare channel name, which defaults to Twitch).
+func newChannelWatcher(spec string) *channelWatcher {
+	providerName, channel := parseChannelSpec(spec)
 
-	resp, err := client.Do(req)
+	provider, err := providerFor(providerName)
 
 	if err != nil {
-		return "", "", err
+		provider = providers[defaultProviderName]
 	}
 
-	var out H
+	return &channelWatcher{
+		name:     spec,
+		channel:  channel,
+		provider: provider,
+		stop:     make(chan struct{}),
+	}
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		return "", "", err
+func (w *channelWatcher) Stitched() *Stitched {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.stitched
+}
+
+func (w *channelWatcher) setStitched(stitched *Stitched) {
+	w.mu.Lock()
+	previous := w.stitched
+	w.stitched = stitched
+	w.mu.Unlock()
+
+	if previous == nil && stitched != nil {
+		events.Publish(EventAdBreakStarted, w.name, stitched)
+
+		metricAdBreaksTotal.WithLabelValues(w.name, stitched.RollType).Inc()
+		metricAdBreakPodLengthSeconds.Observe(float64(stitched.PodLength))
+
+		if history != nil {
+			if err := history.Record(HistoryRecord{
+				Channel:    w.name,
+				StartDate:  stitched.StartDate,
+				RollType:   stitched.RollType,
+				PodLength:  stitched.PodLength,
+				DetectedAt: time.Now(),
+			}); err != nil {
+				log.Error().
+					Err(err).
+					Str("channel_name", w.name).
+					Msg("An error occured while recording ad break history")
+			}
+		}
+	} else if previous != nil && stitched == nil {
+		events.Publish(EventAdBreakEnded, w.name, previous)
 	}
+}
 
-	token := maputil.DeepGet(out, "data.streamPlaybackAccessToken.value").(string)
-	signature := maputil.DeepGet(out, "data.streamPlaybackAccessToken.signature").(string)
+func (w *channelWatcher) PlaylistURL() string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
 
-	return token, signature, nil
+	return w.playlistURL
 }
 
-func fetchPlaylistURL() (string, error) {
-	token, signature, err := getAccessToken(channelName)
+func (w *channelWatcher) setPlaylistURL(url string) {
+	w.mu.Lock()
+	w.playlistURL = url
+	w.mu.Unlock()
+}
 
-	if err != nil {
-		return "", err
+func (w *channelWatcher) setOnline(online bool) {
+	w.mu.Lock()
+	changed := w.online != online
+	w.online = online
+	w.mu.Unlock()
+
+	if !changed {
+		return
 	}
 
-	resp, err := client.Get(
-		fmt.Sprintf(masterPlaylistURL, channelName, url.QueryEscape(token), signature),
-	)
+	if online {
+		metricStreamOnline.WithLabelValues(w.name).Set(1)
+		events.Publish(EventStreamOnline, w.name, nil)
+	} else {
+		metricStreamOnline.WithLabelValues(w.name).Set(0)
+		events.Publish(EventStreamOffline, w.name, nil)
+	}
+}
 
-	if err != nil {
-		return "", err
+func (w *channelWatcher) run() {
+	log := log.With().
+		Str("channel_name", w.name).
+		Logger()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+
+		log.Debug().
+			Msg("Fetching playlist url...")
+
+		url, err := w.provider.ResolvePlaylistURL(context.Background(), w.channel)
+
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("An error occured while fetching playlist url")
+
+			events.Publish(EventPlaylistError, w.name, err.Error())
+		}
+
+		w.setOnline(url != "")
+		w.setPlaylistURL(url)
+
+		if url != "" {
+			log := log.With().
+				Str("playlist_url", url).
+				Logger()
+
+			log.Info().
+				Msg("Channel playlist found")
+
+			if !w.pollStitched(log, url) {
+				return
+			}
+		}
+
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(playlistInterval):
+		}
 	}
+}
 
-	switch resp.StatusCode {
-	case http.StatusOK:
-		p, err := m3u8.Read(resp.Body)
+// pollStitched repeatedly fetches the stitched ad state until the playlist
+// errors out or the watcher is stopped. It returns false if the watcher was
+// stopped, so run() can exit immediately instead of scheduling another poll.
+func (w *channelWatcher) pollStitched(log zerolog.Logger, url string) bool {
+	for {
+		select {
+		case <-w.stop:
+			return false
+		default:
+		}
+
+		log.Debug().
+			Msg("Fetching stitched...")
+
+		stitched, err := fetchStitched(w.provider, url)
 
 		if err != nil {
-			return "", err
+			log.Error().
+				Err(err).
+				Msg("An error occured while fetching stitched")
+
+			events.Publish(EventPlaylistError, w.name, err.Error())
+
+			return true
 		}
 
-		for _, pi := range p.Playlists() {
-			return pi.URI, nil
+		w.setStitched(stitched)
+
+		log.Debug().
+			Interface("stitched", stitched).
+			Msg("Fetched stitched")
+
+		select {
+		case <-w.stop:
+			return false
+		case <-time.After(stitchedInterval):
 		}
 	}
+}
+
+// channelManager tracks the set of channels currently being watched and
+// persists the subscription list to disk so it survives a restart.
+type channelManager struct {
+	path string
 
-	return "", nil
+	mu       sync.Mutex
+	watchers map[string]*channelWatcher
+}
+
+func newChannelManager(path string) *channelManager {
+	return &channelManager{
+		path:     path,
+		watchers: make(map[string]*channelWatcher),
+	}
+}
+
+func (m *channelManager) Add(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.watchers[name]; ok {
+		return false
+	}
+
+	w := newChannelWatcher(name)
+	m.watchers[name] = w
+
+	go w.run()
+
+	m.save()
+
+	return true
+}
+
+func (m *channelManager) Remove(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, ok := m.watchers[name]
+
+	if !ok {
+		return false
+	}
+
+	close(w.stop)
+	delete(m.watchers, name)
+
+	m.save()
+
+	return true
+}
+
+func (m *channelManager) Get(name string) (*channelWatcher, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, ok := m.watchers[name]
+
+	return w, ok
+}
+
+func (m *channelManager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.watchers))
+
+	for name := range m.watchers {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// save writes the current subscription list to disk. Callers must hold m.mu.
+func (m *channelManager) save() {
+	names := make([]string, 0, len(m.watchers))
+
+	for name := range m.watchers {
+		names = append(names, name)
+	}
+
+	data, err := json.Marshal(names)
+
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("An error occured while marshaling channels")
+
+		return
+	}
+
+	if err := os.WriteFile(m.path, data, 0o644); err != nil {
+		log.Error().
+			Err(err).
+			Msg("An error occured while saving channels")
+	}
+}
+
+// Load restores previously subscribed channels from disk, if any.
+func (m *channelManager) Load() error {
+	data, err := os.ReadFile(m.path)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	var names []string
+
+	if err := json.Unmarshal(data, &names); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		m.Add(name)
+	}
+
+	return nil
 }
 
 func fetchPlaylist(url string) (*m3u8.Playlist, error) {
-	resp, err := http.Get(url)
+	start := time.Now()
+
+	resp, err := client.Get(url)
+
+	metricPlaylistFetchDurationSeconds.Observe(time.Since(start).Seconds())
 
 	if err != nil {
+		metricPlaylistFetchErrorsTotal.Inc()
+
 		return nil, err
 	}
 
 	switch resp.StatusCode {
 	case http.StatusOK:
-		return m3u8.Read(resp.Body)
+		p, err := m3u8.Read(resp.Body)
+
+		if err != nil {
+			metricPlaylistFetchErrorsTotal.Inc()
+		}
+
+		return p, err
 	}
 
 	return nil, nil
 }
 
-func fetchStitched(url string) (*Stitched, error) {
+func fetchStitched(provider Provider, url string) (*Stitched, error) {
 	p, err := fetchPlaylist(url)
 
-	if err != nil {
+	if err != nil || p == nil {
 		return nil, err
 	}
 
-	for _, item := range p.Items {
-		switch v := item.(type) {
-		case *m3u8.DateRangeItem:
-			switch *v.Class {
-			case "twitch-stitched-ad":
-				rollType := strings.ToUpper(v.ClientAttributes["X-TV-TWITCH-AD-ROLL-TYPE"])
+	return provider.ParseAdMarkers(p)
+}
+
+func handleListChannels(w http.ResponseWriter, r *http.Request) {
+	w.Header().
+		Set("Content-Type", "application/json")
 
-				if rollType == "PREROLL" {
-					break
-				}
+	json.NewEncoder(w).
+		Encode(H{
+			"data": channels.Names(),
+		})
+}
+
+func handleAddChannel(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
 
-				podLength, err := strconv.Atoi(v.ClientAttributes["X-TV-TWITCH-AD-POD-LENGTH"])
+	if !channels.Add(name) {
+		w.WriteHeader(http.StatusConflict)
 
-				if err != nil {
-					return nil, err
-				}
+		return
+	}
 
-				startDate, err := time.Parse(time.RFC3339, v.StartDate)
+	w.WriteHeader(http.StatusCreated)
+}
 
-				if err != nil {
-					return nil, err
-				}
+func handleRemoveChannel(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
 
-				return &Stitched{startDate, rollType, podLength}, nil
-			}
-		}
+	if !channels.Remove(name) {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
 	}
 
-	return nil, nil
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func startWebServer() error {
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().
-			Set("Content-Type", "application/json")
-
-		json.NewEncoder(w).
-			Encode(H{
-				"data": currentStitched,
-			})
-	})
+func handleGetChannel(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	watcher, ok := channels.Get(name)
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
 
-	return http.ListenAndServe(":3000", handler)
+		return
+	}
+
+	w.Header().
+		Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).
+		Encode(H{
+			"data": watcher.Stitched(),
+		})
 }
 
-func main() {
-	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
 
-	log.Logger = log.Output(zerolog.ConsoleWriter{
-		Out: os.Stdout,
-	})
+	var since, until time.Time
 
-	go startWebServer()
+	if v := query.Get("since"); v != "" {
+		var err error
 
-	for {
-		log := log.With().
-			Str("channel_name", channelName).
-			Logger()
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
 
-		log.Debug().
-			Msg("Fetching playlist url...")
+			return
+		}
+	}
 
-		url, err := fetchPlaylistURL()
+	if v := query.Get("until"); v != "" {
+		var err error
 
-		if err != nil {
-			log.Error().
-				Err(err).
-				Msg("An error occured while fetching playlist url")
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "invalid until", http.StatusBadRequest)
+
+			return
 		}
+	}
 
-		if url != "" {
-			log := log.With().
-				Str("playlist_url", url).
-				Logger()
+	records, err := history.Query(query.Get("channel"), since, until)
 
-			log.Info().
-				Msg("Channel playlist found")
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("An error occured while querying history")
 
-			for {
-				log.Debug().
-					Msg("Fetching stitched...")
+		http.Error(w, "internal server error", http.StatusInternalServerError)
 
-				stitched, err := fetchStitched(url)
+		return
+	}
 
-				if err != nil {
-					log.Error().
-						Err(err).
-						Msg("An error occured while fetching stitched")
+	w.Header().
+		Set("Content-Type", "application/json")
 
-					break
-				}
+	json.NewEncoder(w).
+		Encode(H{
+			"data": records,
+		})
+}
 
-				currentStitched = stitched
+func startWebServer() error {
+	router := mux.NewRouter()
+
+	router.HandleFunc("/channels", handleListChannels).Methods(http.MethodGet)
+	router.HandleFunc("/channels/{name}", handleAddChannel).Methods(http.MethodPost)
+	router.HandleFunc("/channels/{name}", handleRemoveChannel).Methods(http.MethodDelete)
+	router.HandleFunc("/channels/{name}", handleGetChannel).Methods(http.MethodGet)
+	router.HandleFunc("/events", handleEvents).Methods(http.MethodGet)
+	router.HandleFunc("/history", handleHistory).Methods(http.MethodGet)
+	router.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
+	router.HandleFunc("/stream/{channel:[^/.]+}.m3u8", handleStreamPlaylist).Methods(http.MethodGet)
+	router.HandleFunc("/stream/{channel}/segment", handleStreamSegment).Methods(http.MethodGet)
+
+	return http.ListenAndServe(":3000", router)
+}
 
-				log.Debug().
-					Interface("stitched", stitched).
-					Msg("Fetched stitched")
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
 
-				time.Sleep(stitchedInterval)
-			}
-		}
+	log.Logger = log.Output(zerolog.ConsoleWriter{
+		Out: os.Stdout,
+	})
+
+	store, err := openHistoryStore(historyFile)
+
+	if err != nil {
+		log.Fatal().
+			Err(err).
+			Msg("An error occured while opening history store")
+	}
+
+	history = store
+	defer history.Close()
+
+	if err := channels.Load(); err != nil {
+		log.Error().
+			Err(err).
+			Msg("An error occured while loading channels")
+	}
+
+	if channelName != "" {
+		channels.Add(channelName)
+	}
 
-		time.Sleep(playlistInterval)
+	if err := startWebServer(); err != nil {
+		log.Fatal().
+			Err(err).
+			Msg("An error occured while starting the web server")
 	}
 }
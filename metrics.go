@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricAdBreaksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "roli_ad_breaks_total",
+		Help: "Total number of ad breaks detected, by channel and roll type.",
+	}, []string{"channel", "roll_type"})
+
+	metricAdBreakPodLengthSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "roli_ad_break_pod_length_seconds",
+		Help:    "Length of detected ad break pods, in seconds.",
+		Buckets: prometheus.LinearBuckets(30, 30, 10),
+	})
+
+	metricPlaylistFetchDurationSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "roli_playlist_fetch_duration_seconds",
+		Help:    "Duration of media playlist fetches, in seconds.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	metricPlaylistFetchErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "roli_playlist_fetch_errors_total",
+		Help: "Total number of errors encountered while fetching a media playlist.",
+	})
+
+	metricStreamOnline = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "roli_stream_online",
+		Help: "Whether a watched channel's stream is currently online (1) or not (0).",
+	}, []string{"channel"})
+)
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/etherlabsio/go-m3u8/m3u8"
+	"github.com/gookit/goutil/maputil"
+)
+
+const kickChannelURL = "https://kick.com/api/v2/channels/%s"
+
+// KickProvider resolves a Kick channel's playback URL straight from its
+// public channel API, which already hands back a ready-to-use m3u8 URL.
+type KickProvider struct{}
+
+func (p *KickProvider) ResolvePlaylistURL(ctx context.Context, channel string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(kickChannelURL, channel), nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", nil
+	}
+
+	var out H
+
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+
+	url, _ := maputil.DeepGet(out, "playback_url").(string)
+
+	return url, nil
+}
+
+// ParseAdMarkers decodes the SCTE-35 cue-out DateRanges Kick stitches into
+// live HLS playlists to signal an ad break.
+func (p *KickProvider) ParseAdMarkers(playlist *m3u8.Playlist) (*Stitched, error) {
+	return parseCueOutDateRange(playlist, "com.kick.cue-out")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/etherlabsio/go-m3u8/m3u8"
+	"github.com/gookit/goutil/maputil"
+)
+
+const (
+	twitchGraphURL          = "https://gql.twitch.tv/gql"
+	twitchMasterPlaylistURL = "https://usher.ttvnw.net/api/channel/hls/%s.m3u8?token=%s&sig=%s"
+)
+
+// TwitchProvider resolves Twitch channel playlists through the public GQL
+// playback-access-token flow and decodes ad breaks from the
+// "twitch-stitched-ad" DateRange Twitch stitches into the playlist.
+type TwitchProvider struct{}
+
+func (p *TwitchProvider) getAccessToken(channel string) (string, string, error) {
+	s := fmt.Sprintf(
+		`{"query":"{streamPlaybackAccessToken(channelName:\"%s\",params:{platform:\"web\",playerBackend:\"mediaplayer\",playerType:\"site\"}){signature,value}}"}`,
+		channel,
+	)
+
+	req, err := http.NewRequest("POST", twitchGraphURL, strings.NewReader(s))
+
+	if err != nil {
+		return "", "", err
+	}
+
+	req.Header.Set("Client-ID", clientID)
+	req.Header.Set("Content-Type", "text/plain")
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	var out H
+
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", "", err
+	}
+
+	token, ok := maputil.DeepGet(out, "data.streamPlaybackAccessToken.value").(string)
+
+	if !ok {
+		return "", "", fmt.Errorf("no playback access token for channel %q", channel)
+	}
+
+	signature, ok := maputil.DeepGet(out, "data.streamPlaybackAccessToken.signature").(string)
+
+	if !ok {
+		return "", "", fmt.Errorf("no playback access token signature for channel %q", channel)
+	}
+
+	return token, signature, nil
+}
+
+func (p *TwitchProvider) ResolvePlaylistURL(ctx context.Context, channel string) (string, error) {
+	token, signature, err := p.getAccessToken(channel)
+
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Get(
+		fmt.Sprintf(twitchMasterPlaylistURL, channel, url.QueryEscape(token), signature),
+	)
+
+	if err != nil {
+		return "", err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		playlist, err := m3u8.Read(resp.Body)
+
+		if err != nil {
+			return "", err
+		}
+
+		for _, pi := range playlist.Playlists() {
+			return pi.URI, nil
+		}
+	}
+
+	return "", nil
+}
+
+func (p *TwitchProvider) ParseAdMarkers(playlist *m3u8.Playlist) (*Stitched, error) {
+	dateRange, ok := parseStitchedDateRange(playlist, "twitch-stitched-ad")
+
+	if !ok {
+		return nil, nil
+	}
+
+	rollType := strings.ToUpper(dateRange.ClientAttributes["X-TV-TWITCH-AD-ROLL-TYPE"])
+
+	if rollType == "PREROLL" {
+		return nil, nil
+	}
+
+	podLength, err := strconv.Atoi(dateRange.ClientAttributes["X-TV-TWITCH-AD-POD-LENGTH"])
+
+	if err != nil {
+		return nil, err
+	}
+
+	startDate, err := time.Parse(time.RFC3339, dateRange.StartDate)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stitched{startDate, rollType, podLength}, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+
+	"github.com/etherlabsio/go-m3u8/m3u8"
+)
+
+var youtubeHLSManifestRe = regexp.MustCompile(`"hlsManifestUrl":"([^"]+)"`)
+
+// YouTubeLiveProvider resolves a channel's currently live stream the same
+// way ytdl-style tools do: scrape the channel's /live page for the
+// hlsManifestUrl embedded in ytInitialPlayerResponse.
+type YouTubeLiveProvider struct{}
+
+func (p *YouTubeLiveProvider) ResolvePlaylistURL(ctx context.Context, channel string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://www.youtube.com/%s/live", channel), nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return "", err
+	}
+
+	match := youtubeHLSManifestRe.FindSubmatch(body)
+
+	if match == nil {
+		return "", nil
+	}
+
+	return string(match[1]), nil
+}
+
+// ParseAdMarkers decodes the SCTE-35 cue-out DateRanges YouTube stitches into
+// live HLS playlists to signal an ad break.
+func (p *YouTubeLiveProvider) ParseAdMarkers(playlist *m3u8.Playlist) (*Stitched, error) {
+	return parseCueOutDateRange(playlist, "com.google.dai.cue-out")
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/etherlabsio/go-m3u8/m3u8"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+// adWindow is the absolute time range covered by a single twitch-stitched-ad
+// DateRange, used to decide which media segments to drop when restreaming.
+type adWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+func adWindows(p *m3u8.Playlist) []adWindow {
+	var windows []adWindow
+
+	for _, item := range p.Items {
+		dateRange, ok := item.(*m3u8.DateRangeItem)
+
+		if !ok || dateRange.Class == nil || *dateRange.Class != "twitch-stitched-ad" {
+			continue
+		}
+
+		startDate, err := time.Parse(time.RFC3339, dateRange.StartDate)
+
+		if err != nil {
+			continue
+		}
+
+		podLength, err := strconv.Atoi(dateRange.ClientAttributes["X-TV-TWITCH-AD-POD-LENGTH"])
+
+		if err != nil {
+			continue
+		}
+
+		windows = append(windows, adWindow{
+			start: startDate,
+			end:   startDate.Add(time.Duration(podLength) * time.Second),
+		})
+	}
+
+	return windows
+}
+
+func overlapsAnyWindow(start, end time.Time, windows []adWindow) bool {
+	for _, w := range windows {
+		if start.Before(w.end) && end.After(w.start) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func resolveSegmentURL(base *url.URL, uri string) string {
+	ref, err := url.Parse(uri)
+
+	if err != nil {
+		return uri
+	}
+
+	return base.ResolveReference(ref).String()
+}
+
+// sameHost reports whether segmentURL points at the same host as
+// playlistURL, so handleStreamSegment can refuse to proxy arbitrary
+// caller-supplied URLs and only ever fetches from the channel's own CDN.
+func sameHost(playlistURL, segmentURL string) bool {
+	base, err := url.Parse(playlistURL)
+
+	if err != nil {
+		return false
+	}
+
+	target, err := url.Parse(segmentURL)
+
+	if err != nil {
+		return false
+	}
+
+	return target.Host == base.Host
+}
+
+// buildFilteredPlaylist rewrites p's media segments into a playlist text that
+// drops every segment overlapping an active ad DateRange, proxying the
+// remaining segment URIs through this process.
+func buildFilteredPlaylist(channel string, playlistURL string, p *m3u8.Playlist) (string, error) {
+	base, err := url.Parse(playlistURL)
+
+	if err != nil {
+		return "", err
+	}
+
+	windows := adWindows(p)
+
+	var b strings.Builder
+
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", p.Target)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", p.Sequence)
+
+	var current time.Time
+
+	for _, segment := range p.Segments() {
+		if segment.ProgramDateTime != nil {
+			current = segment.ProgramDateTime.Time
+		}
+
+		end := current.Add(time.Duration(segment.Duration * float64(time.Second)))
+
+		if !current.IsZero() && overlapsAnyWindow(current, end, windows) {
+			current = end
+
+			continue
+		}
+
+		resolved := resolveSegmentURL(base, segment.Segment)
+
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", segment.Duration)
+		fmt.Fprintf(&b, "/stream/%s/segment?url=%s\n", channel, url.QueryEscape(resolved))
+
+		current = end
+	}
+
+	return b.String(), nil
+}
+
+func handleStreamPlaylist(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+
+	watcher, ok := channels.Get(channel)
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	playlistURL := watcher.PlaylistURL()
+
+	if playlistURL == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+
+		return
+	}
+
+	p, err := fetchPlaylist(playlistURL)
+
+	if err != nil || p == nil {
+		log.Error().
+			Err(err).
+			Str("channel_name", channel).
+			Msg("An error occured while fetching media playlist for restreaming")
+
+		w.WriteHeader(http.StatusBadGateway)
+
+		return
+	}
+
+	body, err := buildFilteredPlaylist(channel, playlistURL, p)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Write([]byte(body))
+}
+
+func handleStreamSegment(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+
+	segmentURL := r.URL.Query().Get("url")
+
+	if segmentURL == "" {
+		w.WriteHeader(http.StatusBadRequest)
+
+		return
+	}
+
+	watcher, ok := channels.Get(channel)
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	playlistURL := watcher.PlaylistURL()
+
+	if playlistURL == "" || !sameHost(playlistURL, segmentURL) {
+		w.WriteHeader(http.StatusForbidden)
+
+		return
+	}
+
+	resp, err := client.Get(segmentURL)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+
+		return
+	}
+
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	io.Copy(w, resp.Body)
+}